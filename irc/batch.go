@@ -0,0 +1,283 @@
+package irc
+
+// Correlation of IRCv3 batches (the "batch" cap) and labeled responses
+// (the "labeled-response" cap).
+
+import "strconv"
+
+// BATCH is the command used to open and close an IRCv3 batch.
+const BATCH Command = "BATCH"
+
+// A Batch is a group of messages the server has tagged together with
+// the IRCv3 batch cap, e.g. a netsplit or a chathistory playback.
+type Batch struct {
+	// Type is the batch type, the second argument of the opening
+	// BATCH command (e.g. "netsplit", "chathistory").
+	Type string
+
+	// Params are any arguments to the batch beyond its type.
+	Params []string
+
+	// Parent is the batch this one is nested inside, or nil if it is
+	// top level.
+	Parent *Batch
+
+	// Messages are the messages tagged with this batch's reference id
+	// while it was open, in the order they arrived. BATCH messages are
+	// not included: neither this batch's own closing message nor the
+	// opening and closing messages of batches nested inside it.
+	Messages []Message
+}
+
+// A BatchTracker watches a stream of incoming Messages for IRCv3
+// batches, tagging each Message in an open batch with a back-pointer
+// and delivering completed batches to a callback.
+//
+// A BatchTracker is not safe for concurrent use.
+type BatchTracker struct {
+	open map[string]*Batch
+
+	// Done is called with each batch once its closing BATCH message is
+	// seen. It must be set before Handle is called.
+	Done func(*Batch)
+}
+
+// NewBatchTracker returns a BatchTracker that calls done with each
+// batch once it closes.
+func NewBatchTracker(done func(*Batch)) *BatchTracker {
+	return &BatchTracker{open: make(map[string]*Batch), Done: done}
+}
+
+// Handle processes one incoming message: if it is a BATCH open or
+// close, it updates the set of open batches (calling Done on close); if
+// it carries a "batch" tag matching an open batch, it is appended to
+// that batch and tagged with a back-pointer via msg.Batch; either way,
+// it returns the message, now with Batch set if applicable.
+func (t *BatchTracker) Handle(msg Message) Message {
+	if msg.Command == BATCH && len(msg.Arguments) > 0 {
+		switch ref := msg.Arguments[0]; {
+		case len(ref) > 0 && ref[0] == '+':
+			t.open[ref[1:]] = &Batch{
+				Type:   argAt(msg.Arguments, 1),
+				Params: argsFrom(msg.Arguments, 2),
+				Parent: t.parentOf(msg),
+			}
+		case len(ref) > 0 && ref[0] == '-':
+			id := ref[1:]
+			if b, ok := t.open[id]; ok {
+				delete(t.open, id)
+				if t.Done != nil {
+					t.Done(b)
+				}
+			}
+		}
+		return msg
+	}
+
+	if id, ok := msg.Tags["batch"]; ok {
+		if b, ok := t.open[id]; ok {
+			msg.Batch = b
+			b.Messages = append(b.Messages, msg)
+		}
+	}
+	return msg
+}
+
+// Open returns the currently open batch with the given reference id
+// (without its leading '+' or '-'), if any.
+func (t *BatchTracker) Open(ref string) (*Batch, bool) {
+	b, ok := t.open[ref]
+	return b, ok
+}
+
+// parentOf returns the open batch that a nested BATCH open message
+// belongs to, i.e. the batch named by msg's own "batch" tag, or nil if
+// it is top level.
+func (t *BatchTracker) parentOf(msg Message) *Batch {
+	id, ok := msg.Tags["batch"]
+	if !ok {
+		return nil
+	}
+	return t.open[id]
+}
+
+// argAt returns args[i], or "" if there's no such argument.
+func argAt(args []string, i int) string {
+	if i >= len(args) {
+		return ""
+	}
+	return args[i]
+}
+
+// argsFrom returns args[i:], or nil if there aren't that many.
+func argsFrom(args []string, i int) []string {
+	if i >= len(args) {
+		return nil
+	}
+	return args[i:]
+}
+
+// A LabelTracker correlates a client-sent, labeled message with the
+// server's response to it, per the IRCv3 labeled-response
+// specification: every reply tagged with the same label, including the
+// contents of any batch it opens, is collected and delivered together.
+//
+// A LabelTracker is not safe for concurrent use.
+type LabelTracker struct {
+	batches *BatchTracker
+	pending map[string]*labelResponse
+
+	// byBatch maps every batch that is part of a label's response,
+	// including ones nested arbitrarily deep inside the batch that was
+	// opened with the label tag, to that label: it's how a message
+	// tagged with a nested batch's reference id gets collected.
+	byBatch map[*Batch]string
+
+	// root maps a label to the batch that was actually opened with its
+	// label tag, so that batchDone only delivers the response when
+	// that outermost batch closes, not when an inner, nested one does.
+	root map[string]*Batch
+
+	next int
+}
+
+// labelResponse accumulates the messages for one outstanding label.
+type labelResponse struct {
+	ch   chan []Message
+	msgs []Message
+}
+
+// NewLabelTracker returns a LabelTracker. It drives its own
+// BatchTracker internally, since a labeled response may be delivered as
+// a batch.
+func NewLabelTracker() *LabelTracker {
+	t := &LabelTracker{
+		pending: make(map[string]*labelResponse),
+		byBatch: make(map[*Batch]string),
+		root:    make(map[string]*Batch),
+	}
+	t.batches = NewBatchTracker(t.batchDone)
+	return t
+}
+
+// SendLabeled returns a copy of msg with a fresh "label" tag set, and a
+// channel that will receive every message the server tags with that
+// label (the label's ACK or batch-close message is not included). The
+// caller is responsible for actually sending the returned message.
+func (t *LabelTracker) SendLabeled(msg Message) (Message, <-chan []Message) {
+	t.next++
+	label := strconv.Itoa(t.next)
+
+	tags := make(map[string]string, len(msg.Tags)+1)
+	for k, v := range msg.Tags {
+		tags[k] = v
+	}
+	tags["label"] = label
+	msg.Tags = tags
+
+	// msg.Raw, if set (e.g. msg came from Parse), would otherwise make
+	// RawString emit the original string verbatim, silently dropping the
+	// label tag we just added.
+	msg.Raw = ""
+
+	resp := &labelResponse{ch: make(chan []Message, 1)}
+	t.pending[label] = resp
+	return msg, resp.ch
+}
+
+// Handle processes one incoming message, routing it to the response for
+// its "label" tag or, if it is part of a batch opened in response to a
+// labeled message (at any nesting depth), to that label's response. A
+// response is delivered once it is complete: an ACK, an unbatched
+// reply, or the close of the outermost batch a labeled message started.
+func (t *LabelTracker) Handle(msg Message) {
+	// A BATCH open carrying our label associates the new batch with
+	// that label, so that messages inside it (tagged only with
+	// "batch", per the spec) are recognized as part of the response
+	// even though they don't carry the label tag themselves. A BATCH
+	// open with no label of its own, nested inside a tracked batch,
+	// inherits its parent's label, so that nesting of arbitrary depth
+	// is still collected.
+	var openRef string
+	isOpen := false
+	if msg.Command == BATCH && len(msg.Arguments) > 0 {
+		if ref := msg.Arguments[0]; len(ref) > 0 && ref[0] == '+' {
+			openRef, isOpen = ref[1:], true
+		}
+	}
+	openLabel := ""
+	if isOpen {
+		openLabel = msg.Tags["label"]
+	}
+
+	msg = t.batches.Handle(msg)
+
+	if isOpen {
+		if b, ok := t.batches.Open(openRef); ok {
+			switch {
+			case openLabel != "":
+				if _, pending := t.pending[openLabel]; pending {
+					t.byBatch[b] = openLabel
+					t.root[openLabel] = b
+				}
+			case b.Parent != nil:
+				if label, ok := t.byBatch[b.Parent]; ok {
+					t.byBatch[b] = label
+				}
+			}
+		}
+	}
+
+	if msg.Batch != nil {
+		if label, ok := t.byBatch[msg.Batch]; ok {
+			t.pending[label].msgs = append(t.pending[label].msgs, msg)
+		}
+		return
+	}
+
+	label, ok := msg.Tags["label"]
+	if !ok {
+		return
+	}
+	resp, ok := t.pending[label]
+	if !ok {
+		return
+	}
+	switch msg.Command {
+	case "ACK":
+		t.deliver(label, resp)
+	case BATCH:
+		// The open line itself; delivered when the root batch closes.
+	default:
+		resp.msgs = append(resp.msgs, msg)
+		t.deliver(label, resp)
+	}
+}
+
+// batchDone is the BatchTracker callback: once the outermost batch that
+// a labeled message started closes, that label's response is complete.
+// A nested batch closing early doesn't deliver the response: its
+// messages are already in the label's pending response, which is
+// delivered when the root batch closes.
+func (t *LabelTracker) batchDone(b *Batch) {
+	label, ok := t.byBatch[b]
+	if !ok {
+		return
+	}
+	delete(t.byBatch, b)
+	if t.root[label] != b {
+		return
+	}
+	delete(t.root, label)
+	if resp, ok := t.pending[label]; ok {
+		t.deliver(label, resp)
+	}
+}
+
+// deliver sends the accumulated messages for label to its channel and
+// forgets about it.
+func (t *LabelTracker) deliver(label string, resp *labelResponse) {
+	delete(t.pending, label)
+	resp.ch <- resp.msgs
+	close(resp.ch)
+}
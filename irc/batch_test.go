@@ -0,0 +1,141 @@
+package irc
+
+import "testing"
+
+func TestBatchTracker(t *testing.T) {
+	var done *Batch
+	bt := NewBatchTracker(func(b *Batch) { done = b })
+
+	open, _ := Parse("BATCH +123 chathistory #test")
+	bt.Handle(open)
+
+	m1, _ := Parse("@batch=123 :a!a@a PRIVMSG #test :one")
+	m1 = bt.Handle(m1)
+	if m1.Batch == nil || m1.Batch.Type != "chathistory" {
+		t.Fatalf("m1.Batch=%#v, want the open chathistory batch", m1.Batch)
+	}
+
+	m2, _ := Parse("@batch=123 :b!b@b PRIVMSG #test :two")
+	m2 = bt.Handle(m2)
+
+	close_, _ := Parse("BATCH -123")
+	bt.Handle(close_)
+
+	if done == nil {
+		t.Fatal("batch never completed")
+	}
+	if len(done.Messages) != 2 {
+		t.Fatalf("done.Messages=%v, want 2 messages", done.Messages)
+	}
+	if done.Messages[0].Arguments[1] != "one" || done.Messages[1].Arguments[1] != "two" {
+		t.Errorf("done.Messages=%v, wrong order or contents", done.Messages)
+	}
+}
+
+func TestLabelTrackerUnbatchedResponse(t *testing.T) {
+	lt := NewLabelTracker()
+
+	req, _ := Parse("WHOIS nick")
+	labeled, ch := lt.SendLabeled(req)
+	label := labeled.Tags["label"]
+
+	reply, _ := Parse("311 me nick user host * :real name")
+	reply.Tags = map[string]string{"label": label}
+	lt.Handle(reply)
+
+	select {
+	case msgs := <-ch:
+		if len(msgs) != 1 || msgs[0].Command != RplWHOISUSER {
+			t.Errorf("msgs=%v, want the single WHOIS reply", msgs)
+		}
+	default:
+		t.Fatal("response channel never received")
+	}
+}
+
+// Tests that the label tag SendLabeled adds actually survives
+// serialization, even when msg (as built by Parse) has Raw set.
+func TestSendLabeledSurvivesRawString(t *testing.T) {
+	lt := NewLabelTracker()
+
+	req, _ := Parse("WHOIS nick")
+	labeled, _ := lt.SendLabeled(req)
+
+	raw, err := labeled.RawString()
+	if err != nil {
+		t.Fatalf("RawString()=%v", err)
+	}
+	want := "@label=1 WHOIS :nick"
+	if raw != want {
+		t.Errorf("RawString()=%q, want %q", raw, want)
+	}
+}
+
+func TestLabelTrackerBatchedResponse(t *testing.T) {
+	lt := NewLabelTracker()
+
+	req, _ := Parse("CHATHISTORY LATEST #test * 10")
+	labeled, ch := lt.SendLabeled(req)
+	label := labeled.Tags["label"]
+
+	open, _ := Parse("BATCH +abc chathistory #test")
+	open.Tags = map[string]string{"label": label}
+	lt.Handle(open)
+
+	line, _ := Parse("@batch=abc :a!a@a PRIVMSG #test :hi")
+	lt.Handle(line)
+
+	close_, _ := Parse("BATCH -abc")
+	lt.Handle(close_)
+
+	select {
+	case msgs := <-ch:
+		if len(msgs) != 1 || msgs[0].Arguments[1] != "hi" {
+			t.Errorf("msgs=%v, want the single batched message", msgs)
+		}
+	default:
+		t.Fatal("response channel never received")
+	}
+}
+
+// Tests that messages inside a batch nested inside the labeled response's
+// batch are still collected, and that the response is only delivered
+// when the outermost batch closes, not the inner one.
+func TestLabelTrackerNestedBatchedResponse(t *testing.T) {
+	lt := NewLabelTracker()
+
+	req, _ := Parse("CHATHISTORY LATEST #test * 10")
+	labeled, ch := lt.SendLabeled(req)
+	label := labeled.Tags["label"]
+
+	outer, _ := Parse("BATCH +outer chathistory #test")
+	outer.Tags = map[string]string{"label": label}
+	lt.Handle(outer)
+
+	inner, _ := Parse("@batch=outer BATCH +inner netjoin")
+	lt.Handle(inner)
+
+	line, _ := Parse("@batch=inner :a!a@a JOIN #test")
+	lt.Handle(line)
+
+	innerClose, _ := Parse("@batch=outer BATCH -inner")
+	lt.Handle(innerClose)
+
+	select {
+	case <-ch:
+		t.Fatal("response delivered when only the nested batch closed")
+	default:
+	}
+
+	outerClose, _ := Parse("BATCH -outer")
+	lt.Handle(outerClose)
+
+	select {
+	case msgs := <-ch:
+		if len(msgs) != 1 || msgs[0].Command != JOIN {
+			t.Errorf("msgs=%v, want the single nested-batch message", msgs)
+		}
+	default:
+		t.Fatal("response channel never received after outer batch closed")
+	}
+}
@@ -0,0 +1,247 @@
+package irc
+
+// Client-side IRCv3 capability negotiation.
+
+import "strings"
+
+// CAP is the IRCv3 capability negotiation command.
+const CAP Command = "CAP"
+
+// The well-known IRCv3 capabilities that a CapNegotiator can request.
+const (
+	CapMessageTags     = "message-tags"
+	CapServerTime      = "server-time"
+	CapAccountTag      = "account-tag"
+	CapEchoMessage     = "echo-message"
+	CapBatch           = "batch"
+	CapLabeledResponse = "labeled-response"
+	CapMultiPrefix     = "multi-prefix"
+	CapExtendedJoin    = "extended-join"
+	CapAwayNotify      = "away-notify"
+	CapInviteNotify    = "invite-notify"
+	CapChgHost         = "chghost"
+	CapSetName         = "setname"
+	CapSASL            = "sasl"
+)
+
+// maxCapReqBytes is the largest the cap list of a single "CAP REQ :..."
+// line is allowed to be before it is split into multiple requests,
+// leaving room for the "CAP REQ :" prefix and the trailing delimiter
+// under MaxBytes.
+const maxCapReqBytes = 510 - len("CAP REQ :")
+
+// A CapNegotiator drives the client side of the IRCv3 CAP negotiation
+// handshake (CAP LS / CAP REQ / CAP ACK / CAP NAK / CAP END) described at
+// https://ircv3.net/specs/extensions/capability-negotiation.
+//
+// A CapNegotiator is not safe for concurrent use.
+type CapNegotiator struct {
+	// requested is the set of caps the caller asked for, in the order
+	// Request was called.
+	requested []string
+
+	// available is the set of caps the server advertised via CAP LS,
+	// cap → value.
+	available map[string]string
+
+	// enabled is the set of caps the server ACKed, cap → value.
+	enabled map[string]string
+
+	// pending is the set of caps that have been REQed but not yet
+	// ACKed or NAKed.
+	pending map[string]bool
+
+	// lsDone is set once the final (non-continued) CAP LS line is seen.
+	lsDone bool
+
+	// reqSent is set once the CAP REQ lines have been sent.
+	reqSent bool
+
+	// SASL, if true, holds CAP END until EndSASL is called, so that a
+	// Sasl negotiation can run inside the CAP window as required by
+	// the spec.
+	SASL bool
+
+	saslDone bool
+}
+
+// NewCapNegotiator returns a CapNegotiator ready to begin negotiation.
+func NewCapNegotiator() *CapNegotiator {
+	return &CapNegotiator{
+		available: make(map[string]string),
+		enabled:   make(map[string]string),
+		pending:   make(map[string]bool),
+	}
+}
+
+// Request adds capabilities to the set that will be requested. If the
+// server's CAP LS listing hasn't finished yet, caps are folded into the
+// CAP REQ sent once it does, and Request returns nil. If CAP LS has
+// already finished, any of caps the server advertised are requested
+// immediately, and the CAP REQ messages to send are returned; the
+// caller is responsible for actually sending them. It may be called
+// multiple times, including after negotiation has started, so long as
+// it is called before Step reports done.
+func (c *CapNegotiator) Request(caps ...string) []Message {
+	c.requested = append(c.requested, caps...)
+	if !c.lsDone {
+		return nil
+	}
+	return c.sendRequests(caps)
+}
+
+// Enabled returns the set of capabilities the server acknowledged,
+// mapping each cap name to its value (or "" if it has none).
+func (c *CapNegotiator) Enabled() map[string]string {
+	enabled := make(map[string]string, len(c.enabled))
+	for k, v := range c.enabled {
+		enabled[k] = v
+	}
+	return enabled
+}
+
+// Start returns the initial message that begins negotiation: "CAP LS 302".
+func (c *CapNegotiator) Start() Message {
+	return Message{Command: CAP, Arguments: []string{"LS", "302"}}
+}
+
+// EndSASL tells the negotiator that a SASL exchange running inside the
+// CAP window has finished, so it is safe to send CAP END. If every
+// requested cap has already been ACKed or NAKed, it returns the CAP END
+// message to send; otherwise Step sends CAP END once they are. It is a
+// no-op unless SASL is true.
+func (c *CapNegotiator) EndSASL() []Message {
+	c.saslDone = true
+	if c.SASL && c.done() {
+		return []Message{{Command: CAP, Arguments: []string{"END"}}}
+	}
+	return nil
+}
+
+// Step feeds an incoming message to the negotiator. If the message is
+// not a CAP reply it is ignored. It returns any messages the negotiator
+// wants to send in response, and whether negotiation is complete (CAP
+// END has been sent).
+func (c *CapNegotiator) Step(msg Message) ([]Message, bool) {
+	if msg.Command != CAP || len(msg.Arguments) < 2 {
+		return nil, false
+	}
+	// Arguments are: <target> <subcommand> [*] <params...>
+	sub := msg.Arguments[1]
+	rest := msg.Arguments[2:]
+	continued := len(rest) > 0 && rest[0] == "*"
+	if continued {
+		rest = rest[1:]
+	}
+	if len(rest) == 0 {
+		return nil, c.done()
+	}
+	caps := rest[len(rest)-1]
+
+	switch sub {
+	case "LS":
+		for cap, val := range parseCapList(caps) {
+			c.available[cap] = val
+		}
+		if !continued {
+			c.lsDone = true
+			c.reqSent = true
+			msgs := c.sendRequests(c.requested)
+			if len(msgs) == 0 && c.done() {
+				return []Message{{Command: CAP, Arguments: []string{"END"}}}, true
+			}
+			return msgs, c.done()
+		}
+
+	case "ACK":
+		for cap := range parseCapList(caps) {
+			cap = strings.TrimPrefix(cap, "-")
+			c.enabled[cap] = c.available[cap]
+			delete(c.pending, cap)
+		}
+
+	case "NAK":
+		for cap := range parseCapList(caps) {
+			delete(c.pending, cap)
+		}
+	}
+
+	if c.reqSent && len(c.pending) == 0 && c.done() {
+		return []Message{{Command: CAP, Arguments: []string{"END"}}}, true
+	}
+	return nil, false
+}
+
+// sendRequests filters caps down to the ones that are available but not
+// yet pending or resolved, marks them pending, and returns the CAP REQ
+// messages needed to request them, split into chunks that stay under
+// MaxBytes. It is used both for the initial batch once CAP LS finishes
+// and for caps added via Request afterward.
+func (c *CapNegotiator) sendRequests(caps []string) []Message {
+	var want []string
+	for _, cap := range caps {
+		if c.pending[cap] {
+			continue
+		}
+		if _, ok := c.enabled[cap]; ok {
+			continue
+		}
+		if _, ok := c.available[cap]; ok {
+			want = append(want, cap)
+			c.pending[cap] = true
+		}
+	}
+	if len(want) == 0 {
+		return nil
+	}
+
+	var msgs []Message
+	for _, chunk := range chunkCaps(want, maxCapReqBytes) {
+		msgs = append(msgs, Message{
+			Command:   CAP,
+			Arguments: []string{"REQ", chunk},
+		})
+	}
+	return msgs
+}
+
+// done reports whether negotiation may conclude: CAP LS has finished,
+// every requested cap has been ACKed or NAKed, and, if SASL is in use,
+// the SASL exchange has completed.
+func (c *CapNegotiator) done() bool {
+	return c.lsDone && c.reqSent && len(c.pending) == 0 && (!c.SASL || c.saslDone)
+}
+
+// parseCapList parses a space-separated "CAP LS"/"CAP ACK"/"CAP NAK"
+// capability list, returning cap → value (value is "" if the cap has
+// none).
+func parseCapList(s string) map[string]string {
+	caps := make(map[string]string)
+	for _, field := range strings.Fields(s) {
+		cap, val := splitString(field, "=")
+		caps[cap] = val
+	}
+	return caps
+}
+
+// chunkCaps joins caps with spaces into as few strings as possible, none
+// of which exceed max bytes.
+func chunkCaps(caps []string, max int) []string {
+	var chunks []string
+	cur := ""
+	for _, cap := range caps {
+		switch {
+		case cur == "":
+			cur = cap
+		case len(cur)+1+len(cap) > max:
+			chunks = append(chunks, cur)
+			cur = cap
+		default:
+			cur += " " + cap
+		}
+	}
+	if cur != "" {
+		chunks = append(chunks, cur)
+	}
+	return chunks
+}
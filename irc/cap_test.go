@@ -0,0 +1,91 @@
+package irc
+
+import "testing"
+
+// Tests a full negotiation: LS (split over two lines), REQ, ACK, END.
+func TestCapNegotiatorFullFlow(t *testing.T) {
+	c := NewCapNegotiator()
+	c.Request(CapServerTime, CapBatch, "unsupported-cap")
+
+	ls1, _ := Parse("CAP * LS * :multi-prefix sasl")
+	if reply, done := c.Step(ls1); reply != nil || done {
+		t.Fatalf("Step(continued LS)=%#v, %v, want nil, false", reply, done)
+	}
+
+	ls2, _ := Parse("CAP * LS :server-time batch")
+	reply, done := c.Step(ls2)
+	if done {
+		t.Fatalf("Step(final LS) reported done before REQ resolved")
+	}
+	if len(reply) != 1 || reply[0].Command != CAP || reply[0].Arguments[0] != "REQ" {
+		t.Fatalf("Step(final LS)=%#v, want a single CAP REQ", reply)
+	}
+
+	ack, _ := Parse("CAP * ACK :server-time batch")
+	reply, done = c.Step(ack)
+	if !done {
+		t.Fatalf("Step(ACK) done=false, want true")
+	}
+	if len(reply) != 1 || reply[0].Arguments[0] != "END" {
+		t.Fatalf("Step(ACK)=%#v, want a single CAP END", reply)
+	}
+
+	enabled := c.Enabled()
+	if _, ok := enabled[CapServerTime]; !ok {
+		t.Errorf("Enabled()=%v, missing %s", enabled, CapServerTime)
+	}
+	if _, ok := enabled["unsupported-cap"]; ok {
+		t.Errorf("Enabled()=%v, should not contain unrequested-by-server cap", enabled)
+	}
+}
+
+// Tests that a cap Requested after CAP LS has already completed is
+// still requested, per Request's doc comment, instead of being silently
+// dropped.
+func TestCapNegotiatorLateRequest(t *testing.T) {
+	c := NewCapNegotiator()
+	c.Request(CapServerTime)
+
+	ls, _ := Parse("CAP * LS :server-time batch")
+	reply, done := c.Step(ls)
+	if done {
+		t.Fatalf("Step(LS) reported done before REQ resolved")
+	}
+	if len(reply) != 1 || reply[0].Arguments[0] != "REQ" {
+		t.Fatalf("Step(LS)=%#v, want a single CAP REQ", reply)
+	}
+
+	late := c.Request(CapBatch)
+	if len(late) != 1 || late[0].Command != CAP || late[0].Arguments[0] != "REQ" || late[0].Arguments[1] != CapBatch {
+		t.Fatalf("Request(after LS)=%#v, want a single CAP REQ for %s", late, CapBatch)
+	}
+
+	ack, _ := Parse("CAP * ACK :server-time batch")
+	reply, done = c.Step(ack)
+	if !done {
+		t.Fatalf("Step(ACK) done=false, want true")
+	}
+	if len(reply) != 1 || reply[0].Arguments[0] != "END" {
+		t.Fatalf("Step(ACK)=%#v, want a single CAP END", reply)
+	}
+
+	enabled := c.Enabled()
+	if _, ok := enabled[CapBatch]; !ok {
+		t.Errorf("Enabled()=%v, missing late-requested %s", enabled, CapBatch)
+	}
+}
+
+func TestChunkCaps(t *testing.T) {
+	caps := []string{"aaaa", "bbbb", "cccc"}
+	chunks := chunkCaps(caps, 9)
+	want := []string{"aaaa bbbb", "cccc"}
+	if len(chunks) != len(want) {
+		t.Fatalf("chunkCaps=%v, want %v", chunks, want)
+	}
+	for i := range want {
+		if chunks[i] != want[i] {
+			t.Errorf("chunkCaps=%v, want %v", chunks, want)
+			break
+		}
+	}
+}
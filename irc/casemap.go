@@ -0,0 +1,179 @@
+package irc
+
+// Casemapping-aware folding of nicks and channel names, and an RPL_BOUNCE
+// (005, commonly called ISUPPORT) parser used to discover which mapping a
+// server uses.
+
+import "strings"
+
+// A Casemapping is one of the folding rules an IRC server may advertise
+// via the ISUPPORT CASEMAPPING token.
+type Casemapping string
+
+// The casemappings defined by the IRC client protocol.
+const (
+	CasemappingASCII         Casemapping = "ascii"
+	CasemappingRFC1459       Casemapping = "rfc1459"
+	CasemappingRFC1459Strict Casemapping = "rfc1459-strict"
+)
+
+// Fold returns s with upper-case letters folded to lower case according
+// to the casemapping. rfc1459 and rfc1459-strict additionally fold '[',
+// ']' and '\' to '{', '}' and '|', punctuation the protocol treats as
+// case variants of each other; rfc1459 also folds '^' to '~', a pairing
+// rfc1459-strict omits. Unrecognized casemappings fall back to ascii
+// folding.
+func (c Casemapping) Fold(s string) string {
+	var b strings.Builder
+	b.Grow(len(s))
+	for _, r := range s {
+		switch {
+		case r >= 'A' && r <= 'Z':
+			r += 'a' - 'A'
+		case c == CasemappingRFC1459 || c == CasemappingRFC1459Strict:
+			switch r {
+			case '[':
+				r = '{'
+			case ']':
+				r = '}'
+			case '\\':
+				r = '|'
+			case '^':
+				if c == CasemappingRFC1459 {
+					r = '~'
+				}
+			}
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// Equal reports whether a and b are the same nick or channel name under
+// the casemapping.
+func (c Casemapping) Equal(a, b string) bool {
+	return c.Fold(a) == c.Fold(b)
+}
+
+// A Name is a nick or channel name paired with the casemapping used to
+// compare it, so that it can be folded into a canonical, comparable
+// form. This lets callers key a map of channels or users correctly
+// under whatever casemapping the server advertised, rather than
+// assuming ascii or rfc1459 folding.
+type Name struct {
+	Raw         string
+	Casemapping Casemapping
+}
+
+// Fold returns the canonical form of the name under its casemapping,
+// suitable for use as a map key.
+func (n Name) Fold() string {
+	return n.Casemapping.Fold(n.Raw)
+}
+
+// Equal reports whether n and m are the same name, comparing folded
+// forms under n's casemapping.
+func (n Name) Equal(m Name) bool {
+	return n.Casemapping.Fold(n.Raw) == n.Casemapping.Fold(m.Raw)
+}
+
+// String returns the name's raw, unfolded form.
+func (n Name) String() string {
+	return n.Raw
+}
+
+// An ISupport holds the tokens advertised by a server's RPL_BOUNCE (005)
+// replies, accumulated across possibly several such replies.
+type ISupport struct {
+	tokens map[string]string
+}
+
+// NewISupport returns an empty ISupport ready to have RPL_BOUNCE replies
+// added with Add.
+func NewISupport() *ISupport {
+	return &ISupport{tokens: make(map[string]string)}
+}
+
+// Add parses the arguments of an RPL_BOUNCE message and merges its
+// tokens in. Each argument is either "KEY" or "KEY=VALUE"; the final
+// argument, the human-readable "are supported by this server" trailer,
+// is ignored since it never contains a token. Values are unescaped using
+// the ISUPPORT "\xHH" hex-escape convention.
+func (s *ISupport) Add(msg Message) {
+	if msg.Command != RplBOUNCE {
+		return
+	}
+	args := msg.Arguments
+	if len(args) > 0 {
+		args = args[:len(args)-1] // drop the trailing human-readable text.
+	}
+	if len(args) > 0 {
+		args = args[1:] // drop the leading target nick.
+	}
+	for _, arg := range args {
+		key, val := splitString(arg, "=")
+		s.tokens[key] = unescapeISupport(val)
+	}
+}
+
+// Get returns the value of an ISUPPORT token and whether it was
+// advertised. A valueless token (e.g. "EXCEPTS") is present with value
+// "".
+func (s *ISupport) Get(key string) (string, bool) {
+	val, ok := s.tokens[key]
+	return val, ok
+}
+
+// Casemapping returns the casemapping the server advertised via the
+// CASEMAPPING token, defaulting to rfc1459 (the protocol default) if the
+// server didn't advertise one or advertised an unrecognized value.
+func (s *ISupport) Casemapping() Casemapping {
+	switch Casemapping(s.tokens["CASEMAPPING"]) {
+	case CasemappingASCII:
+		return CasemappingASCII
+	case CasemappingRFC1459Strict:
+		return CasemappingRFC1459Strict
+	default:
+		return CasemappingRFC1459
+	}
+}
+
+// unescapeISupport decodes the ISUPPORT "\xHH" hex-escape sequences used
+// to carry otherwise-unrepresentable characters (such as a literal
+// space) in a token value.
+func unescapeISupport(v string) string {
+	if !strings.ContainsRune(v, '\\') {
+		return v
+	}
+	var b strings.Builder
+	for i := 0; i < len(v); i++ {
+		if v[i] != '\\' || i+3 >= len(v) || v[i+1] != 'x' {
+			b.WriteByte(v[i])
+			continue
+		}
+		hi, okHi := hexDigit(v[i+2])
+		lo, okLo := hexDigit(v[i+3])
+		if !okHi || !okLo {
+			b.WriteByte(v[i])
+			continue
+		}
+		b.WriteByte(hi<<4 | lo)
+		i += 3
+	}
+	return b.String()
+}
+
+// hexDigit returns the value of a single hex digit and whether c was
+// one.
+func hexDigit(c byte) (byte, bool) {
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0', true
+	case c >= 'a' && c <= 'f':
+		return c - 'a' + 10, true
+	case c >= 'A' && c <= 'F':
+		return c - 'A' + 10, true
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,56 @@
+package irc
+
+import "testing"
+
+func TestCasemappingFold(t *testing.T) {
+	tests := []struct {
+		c    Casemapping
+		s    string
+		want string
+	}{
+		{CasemappingASCII, "Foo[Bar]^", "foo[bar]^"},
+		{CasemappingRFC1459, "Foo[Bar]^", "foo{bar}~"},
+		{CasemappingRFC1459Strict, "Foo[Bar]^", "foo{bar}^"},
+	}
+	for _, test := range tests {
+		if got := test.c.Fold(test.s); got != test.want {
+			t.Errorf("%s.Fold(%q)=%q, want %q", test.c, test.s, got, test.want)
+		}
+	}
+}
+
+func TestCasemappingEqual(t *testing.T) {
+	if !CasemappingRFC1459.Equal("Test[Nick]", "test{nick}") {
+		t.Errorf("rfc1459 should equate [] with {}")
+	}
+	if CasemappingASCII.Equal("Test[Nick]", "test{nick}") {
+		t.Errorf("ascii should not equate [] with {}")
+	}
+}
+
+func TestISupportCasemapping(t *testing.T) {
+	s := NewISupport()
+	msg, _ := Parse(":server 005 me CASEMAPPING=ascii NICKLEN=30 :are supported by this server")
+	s.Add(msg)
+	if got := s.Casemapping(); got != CasemappingASCII {
+		t.Errorf("Casemapping()=%s, want %s", got, CasemappingASCII)
+	}
+	if val, ok := s.Get("NICKLEN"); !ok || val != "30" {
+		t.Errorf("Get(NICKLEN)=%q, %v, want \"30\", true", val, ok)
+	}
+}
+
+func TestISupportDefaultCasemapping(t *testing.T) {
+	s := NewISupport()
+	if got := s.Casemapping(); got != CasemappingRFC1459 {
+		t.Errorf("Casemapping()=%s, want default %s", got, CasemappingRFC1459)
+	}
+}
+
+func TestNameEqual(t *testing.T) {
+	a := Name{Raw: "Test[Nick]", Casemapping: CasemappingRFC1459}
+	b := Name{Raw: "test{nick}", Casemapping: CasemappingRFC1459}
+	if !a.Equal(b) {
+		t.Errorf("%v.Equal(%v)=false, want true", a, b)
+	}
+}
@@ -7,12 +7,24 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"sort"
 	"strings"
 )
 
-// MaxBytes is the maximum size of a message in bytes.
+// MaxBytes is the maximum size of a message in bytes, not counting the
+// IRCv3 message-tags section. See MaxTagBytes for that cap.
 const MaxBytes = 512
 
+// MaxTagBytes is the maximum size, in bytes, of the leading IRCv3
+// "@tags " section of a message, not including the leading '@' or the
+// trailing space that separates it from the rest of the message.
+//
+// The specification allows 4094 bytes for client-to-server messages and
+// 8191 bytes for server-to-client messages. This package is mostly used
+// to read what a server sends, so it uses the larger, more permissive
+// bound.
+const MaxTagBytes = 8191
+
 // delimiter is the marker delineating messages in the TCP stream.
 const delimiter = "\r\n"
 
@@ -221,6 +233,14 @@ const (
 	ErrNOOPERHOST                = "491"
 	ErrUMODEUNKNOWNFLAG          = "501"
 	ErrUSERSDONTMATCH            = "502"
+
+	// SASL numerics, added by the IRCv3 sasl-3.1 and sasl-3.2
+	// specifications. Not part of RFC 2812.
+	RplSASLSUCCESS = "903"
+	ErrSASLFAIL    = "904"
+	ErrSASLTOOLONG = "905"
+	ErrSASLABORTED = "906"
+	ErrSASLALREADY = "907"
 )
 
 // A Message is the basic unit of communication in the IRC protocol.
@@ -228,6 +248,14 @@ type Message struct {
 	// Raw is the raw message string.
 	Raw string
 
+	// Tags is the set of IRCv3 message tags attached to the message,
+	// or nil if the message had no tags.
+	//
+	// Values are unescaped: "\:" → ";", "\s" → space, "\\" → "\",
+	// "\r" → CR, and "\n" → LF. A tag with no "=" or an empty value
+	// both map to "".
+	Tags map[string]string
+
 	// Origin is either the nick or server that originated the message.
 	Origin string
 
@@ -248,6 +276,10 @@ type Message struct {
 
 	// Arguments is the message's argument list.
 	Arguments []string
+
+	// Batch is the batch this message belongs to, as tracked by a
+	// BatchTracker, or nil if it is not part of one.
+	Batch *Batch
 }
 
 // RawString returns the raw string representation of a message.
@@ -256,11 +288,15 @@ type Message struct {
 // generating the raw string then the string is invalid and an
 // error is returned.
 func (m Message) RawString() (string, error) {
+	tags := ""
 	raw := ""
 	if m.Raw != "" {
 		raw = m.Raw
 		goto out
 	}
+	if len(m.Tags) > 0 {
+		tags = "@" + encodeTags(m.Tags) + " "
+	}
 	if m.Origin != "" {
 		raw += ":" + m.Origin
 		if m.User != "" {
@@ -277,10 +313,99 @@ func (m Message) RawString() (string, error) {
 		}
 	}
 out:
+	if m.Raw != "" && raw[0] == '@' {
+		// Split a parsed message's tag section off so that only the
+		// rest of it is checked against MaxBytes.
+		if i := strings.IndexByte(raw, ' '); i >= 0 {
+			tags, raw = raw[:i+1], raw[i+1:]
+		}
+	}
+	if n := len(tags); n > 0 && n-2 > MaxTagBytes {
+		return "", MsgTooLong{tags, n - 2 - MaxTagBytes}
+	}
 	if len(raw) > MaxBytes-len(delimiter) {
 		return "", MsgTooLong{raw, len(raw) - (MaxBytes - len(delimiter))}
 	}
-	return strings.TrimRight(raw, "\n"), nil
+	return tags + strings.TrimRight(raw, "\n"), nil
+}
+
+// encodeTags returns the IRCv3 wire encoding of a tag set, without the
+// leading '@' or trailing space, e.g. "a=b;c=d\\se".
+//
+// Keys are sorted so that the output is deterministic.
+func encodeTags(tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		if v := tags[k]; v != "" {
+			parts[i] = k + "=" + escapeTagValue(v)
+		} else {
+			parts[i] = k
+		}
+	}
+	return strings.Join(parts, ";")
+}
+
+// escapeTagValue escapes a tag value for the wire, the inverse of
+// unescapeTagValue.
+func escapeTagValue(v string) string {
+	var b strings.Builder
+	for i := 0; i < len(v); i++ {
+		switch v[i] {
+		case '\\':
+			b.WriteString(`\\`)
+		case ';':
+			b.WriteString(`\:`)
+		case ' ':
+			b.WriteString(`\s`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\n':
+			b.WriteString(`\n`)
+		default:
+			b.WriteByte(v[i])
+		}
+	}
+	return b.String()
+}
+
+// unescapeTagValue decodes the IRCv3 tag-value escaping: "\:" → ";",
+// "\s" → space, "\\" → "\", "\r" → CR, "\n" → LF. A backslash before
+// any other character, or a trailing backslash, is simply dropped.
+func unescapeTagValue(v string) string {
+	if !strings.ContainsRune(v, '\\') {
+		return v
+	}
+	var b strings.Builder
+	for i := 0; i < len(v); i++ {
+		if v[i] != '\\' {
+			b.WriteByte(v[i])
+			continue
+		}
+		i++
+		if i >= len(v) {
+			break
+		}
+		switch v[i] {
+		case ':':
+			b.WriteByte(';')
+		case 's':
+			b.WriteByte(' ')
+		case '\\':
+			b.WriteByte('\\')
+		case 'r':
+			b.WriteByte('\r')
+		case 'n':
+			b.WriteByte('\n')
+		default:
+			b.WriteByte(v[i])
+		}
+	}
+	return b.String()
 }
 
 // Parse parses a message from a raw message string.
@@ -292,6 +417,23 @@ func Parse(data string) (Message, error) {
 	var msg Message
 	msg.Raw = data
 
+	if data[0] == '@' {
+		var tagStr string
+		tagStr, data = splitString(data[1:], " ")
+		msg.Tags = make(map[string]string)
+		for _, tag := range strings.Split(tagStr, ";") {
+			if tag == "" {
+				continue
+			}
+			key, val := splitString(tag, "=")
+			msg.Tags[key] = unescapeTagValue(val)
+		}
+	}
+
+	if len(data) == 0 {
+		return Message{}, errors.New("empty message after tags")
+	}
+
 	if data[0] == ':' {
 		var prefix string
 		prefix, data = splitString(data[1:], " ")
@@ -348,8 +490,14 @@ func splitString(s string, delim string) (head string, cons string) {
 
 // ReadMsgData returns the raw data for the next message from the stream.
 // On error the returned string will be empty.
+//
+// A '@' in the first byte of the message switches the state machine into
+// tag-scanning mode, in which bytes count against MaxTagBytes instead of
+// MaxBytes, until the space that ends the tag section is seen.
 func readMsgData(in *bufio.Reader) (string, error) {
 	var msg []byte
+	inTags := false
+	tagEnd := -1 // index into msg just past the tag section, or -1 if there were no tags.
 	for {
 		switch c, err := in.ReadByte(); {
 		case err == io.EOF && len(msg) > 0:
@@ -380,7 +528,23 @@ func readMsgData(in *bufio.Reader) (string, error) {
 			}
 			return string(msg), nil
 
-		case len(msg) >= MaxBytes-len(delimiter):
+		case len(msg) == 0 && c == '@':
+			inTags = true
+			msg = append(msg, c)
+
+		case inTags && c == ' ':
+			inTags = false
+			tagEnd = len(msg) + 1
+			msg = append(msg, c)
+
+		case inTags && len(msg) > MaxTagBytes:
+			n, _ := junk(in)
+			return "", MsgTooLong{Message: string(msg), NTrunc: n + 1}
+
+		case inTags:
+			msg = append(msg, c)
+
+		case bodyLen(msg, tagEnd) >= MaxBytes-len(delimiter):
 			n, _ := junk(in)
 			return "", MsgTooLong{Message: string(msg[:len(msg)-1]), NTrunc: n + 1}
 
@@ -390,6 +554,15 @@ func readMsgData(in *bufio.Reader) (string, error) {
 	}
 }
 
+// BodyLen returns the number of bytes of msg that come after the tag
+// section, which ends at tagEnd, or -1 if there is no tag section.
+func bodyLen(msg []byte, tagEnd int) int {
+	if tagEnd < 0 {
+		return len(msg)
+	}
+	return len(msg) - tagEnd
+}
+
 // Junk reads and discards bytes until the next message marker is found,
 // returning the number of discarded non-marker bytes.
 func junk(in *bufio.Reader) (int, error) {
@@ -0,0 +1,85 @@
+package irc
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Tests Parse on messages with IRCv3 message tags.
+func TestParseTags(t *testing.T) {
+	tests := []struct {
+		raw  string
+		tags map[string]string
+	}{
+		{
+			raw:  "@id=123 PRIVMSG #test :hi",
+			tags: map[string]string{"id": "123"},
+		},
+		{
+			raw:  "@a=1;b PRIVMSG #test :hi",
+			tags: map[string]string{"a": "1", "b": ""},
+		},
+		{
+			raw:  `@a=b\sc\:d\\e\rf\ng PRIVMSG #test :hi`,
+			tags: map[string]string{"a": "b c;d\\e\rf\ng"},
+		},
+		{
+			raw:  "PRIVMSG #test :hi",
+			tags: nil,
+		},
+	}
+	for _, test := range tests {
+		m, err := Parse(test.raw)
+		if err != nil {
+			t.Errorf("Parse(%q)=%v", test.raw, err)
+			continue
+		}
+		if !reflect.DeepEqual(m.Tags, test.tags) {
+			t.Errorf("Parse(%q).Tags=%#v, want %#v", test.raw, m.Tags, test.tags)
+		}
+	}
+}
+
+// Tests that RawString re-emits tags with escaping, in sorted key order.
+func TestRawStringTags(t *testing.T) {
+	m := Message{
+		Tags:      map[string]string{"b": "1", "a": "x y;z"},
+		Command:   PRIVMSG,
+		Arguments: []string{"#test", "hi"},
+	}
+	raw, err := m.RawString()
+	if err != nil {
+		t.Fatalf("RawString()=%v", err)
+	}
+	want := `@a=x\sy\:z;b=1 PRIVMSG #test :hi`
+	if raw != want {
+		t.Errorf("RawString()=%q, want %q", raw, want)
+	}
+}
+
+// Tests that a message parsed from the wire round-trips through
+// RawString without duplicating its tag section: Parse sets Raw to the
+// original string (tags included), so RawString must not also
+// re-synthesize tags from m.Tags on that path.
+func TestRawStringTagsNoDuplicateOnParsedMessage(t *testing.T) {
+	const raw = "@account=bob;id=123 :nick!user@host PRIVMSG #chan :hello"
+	m, err := Parse(raw)
+	if err != nil {
+		t.Fatalf("Parse(%q)=%v", raw, err)
+	}
+	got, err := m.RawString()
+	if err != nil {
+		t.Fatalf("RawString()=%v", err)
+	}
+	if got != raw {
+		t.Errorf("RawString()=%q, want %q", got, raw)
+	}
+}
+
+// Tests that Parse doesn't panic on a message that is only a tag
+// section with no command.
+func TestParseTagsOnlyNoCommand(t *testing.T) {
+	if _, err := Parse("@id=1"); err == nil {
+		t.Errorf("Parse(\"@id=1\")=nil error, want an error")
+	}
+}
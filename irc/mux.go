@@ -0,0 +1,276 @@
+package irc
+
+// A batteries-included event loop: a Command-keyed handler registry, a
+// Serve loop built on the existing parser, and a few common
+// middlewares.
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// A HandlerFunc handles a single incoming Message.
+type HandlerFunc func(context.Context, Message) error
+
+// A Middleware wraps a HandlerFunc to add behavior such as logging,
+// recovery, or auto-replies, calling next to continue dispatch.
+type Middleware func(next HandlerFunc) HandlerFunc
+
+// A Mux dispatches incoming Messages to handlers registered by Command.
+//
+// A Mux is safe for concurrent use.
+type Mux struct {
+	mu         sync.Mutex
+	handlers   map[Command]HandlerFunc
+	def        HandlerFunc
+	middleware []Middleware
+}
+
+// NewMux returns an empty Mux.
+func NewMux() *Mux {
+	return &Mux{handlers: make(map[Command]HandlerFunc)}
+}
+
+// Handle registers h as the handler for cmd, replacing any handler
+// previously registered for it.
+func (m *Mux) Handle(cmd Command, h HandlerFunc) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.handlers[cmd] = h
+}
+
+// HandleFunc is a convenience wrapper for Handle that accepts a plain
+// function instead of a HandlerFunc.
+func (m *Mux) HandleFunc(cmd Command, h func(context.Context, Message) error) {
+	m.Handle(cmd, HandlerFunc(h))
+}
+
+// HandleDefault registers h as the handler for any Command with no
+// handler of its own.
+func (m *Mux) HandleDefault(h HandlerFunc) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.def = h
+}
+
+// Use appends middleware to the chain wrapping every dispatch. Handlers
+// see the middleware in the order they were added: the first one added
+// runs first and is the last to return.
+func (m *Mux) Use(mw ...Middleware) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.middleware = append(m.middleware, mw...)
+}
+
+// Dispatch runs the handler registered for msg.Command (or the default
+// handler, if any), wrapped in the registered middleware.
+func (m *Mux) Dispatch(ctx context.Context, msg Message) error {
+	m.mu.Lock()
+	h, ok := m.handlers[msg.Command]
+	if !ok {
+		h = m.def
+	}
+	mws := append([]Middleware(nil), m.middleware...)
+	m.mu.Unlock()
+
+	if h == nil {
+		h = func(context.Context, Message) error { return nil }
+	}
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h(ctx, msg)
+}
+
+// Serve reads and parses messages from in until an error occurs,
+// dispatching each to m. A Writer wrapping out is installed in the
+// context passed to handlers and middleware; retrieve it with
+// WriterFromContext to send replies. Serve returns nil on io.EOF, a
+// MsgTooLong is dispatched (the message is still parsed and handled)
+// rather than treated as fatal, and any other read or handler error
+// stops the loop and is returned.
+//
+// A panic while reading or parsing a single message (e.g. a bug
+// tripped by malformed input from a flaky or hostile peer) is
+// recovered, logged, and skipped rather than taking down the loop; see
+// RecoveryMiddleware for the equivalent protection around handlers.
+func (m *Mux) Serve(ctx context.Context, in *bufio.Reader, out io.Writer) error {
+	ctx = context.WithValue(ctx, writerCtxKey{}, NewWriter(out))
+	for {
+		msg, err := safeRead(in)
+		switch err.(type) {
+		case nil, MsgTooLong:
+			// Fall through to dispatch.
+
+		case recoveredPanic:
+			log.Print(err)
+			continue
+
+		default:
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if err := m.Dispatch(ctx, msg); err != nil {
+			return err
+		}
+	}
+}
+
+// recoveredPanic wraps a panic value recovered by safeRead.
+type recoveredPanic struct {
+	v interface{}
+}
+
+func (e recoveredPanic) Error() string {
+	return fmt.Sprintf("irc: recovered from panic reading a message: %v", e.v)
+}
+
+// safeRead calls read, recovering from any panic so that a single
+// malformed message can't crash the Serve loop.
+func safeRead(in *bufio.Reader) (msg Message, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = recoveredPanic{r}
+		}
+	}()
+	return read(in)
+}
+
+// A Writer sends Messages on a connection.
+type Writer struct {
+	out io.Writer
+}
+
+// NewWriter returns a Writer that sends Messages to out.
+func NewWriter(out io.Writer) *Writer {
+	return &Writer{out: out}
+}
+
+// Send writes msg's raw string form to the underlying writer, followed
+// by the message delimiter. If msg is too long to send, MsgTooLong is
+// returned instead of silently truncating it.
+func (w *Writer) Send(msg Message) error {
+	raw, err := msg.RawString()
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w.out, raw+delimiter)
+	return err
+}
+
+// writerCtxKey is the context key Serve uses to store the Writer for
+// the connection being served.
+type writerCtxKey struct{}
+
+// WriterFromContext returns the Writer that Mux.Serve installed in ctx
+// for the connection currently being handled.
+func WriterFromContext(ctx context.Context) (*Writer, bool) {
+	w, ok := ctx.Value(writerCtxKey{}).(*Writer)
+	return w, ok
+}
+
+// PingMiddleware automatically replies to PING messages with a PONG
+// that echoes the same arguments, using the Writer installed in ctx by
+// Mux.Serve. Any other Command is passed on to next.
+func PingMiddleware(next HandlerFunc) HandlerFunc {
+	return func(ctx context.Context, msg Message) error {
+		if msg.Command != PING {
+			return next(ctx, msg)
+		}
+		w, ok := WriterFromContext(ctx)
+		if !ok {
+			return nil
+		}
+		return w.Send(Message{Command: PONG, Arguments: msg.Arguments})
+	}
+}
+
+// RecoveryMiddleware recovers a panic in a later handler or middleware,
+// logs it with the standard log package, and returns it as an error
+// instead of letting it crash the Serve loop.
+func RecoveryMiddleware(next HandlerFunc) HandlerFunc {
+	return func(ctx context.Context, msg Message) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("irc: panic handling %s: %v", msg.Command, r)
+				err = fmt.Errorf("panic handling %s: %v", msg.Command, r)
+			}
+		}()
+		return next(ctx, msg)
+	}
+}
+
+// DefaultRateLimit and DefaultRateLimitBurst are the rate and burst
+// size NewRateLimiter uses if not overridden.
+const (
+	DefaultRateLimit      = 2.0 // messages per second
+	DefaultRateLimitBurst = 5
+)
+
+// A RateLimiter paces outbound messages sent through a Writer using a
+// token-bucket algorithm, so a handler can send freely without
+// flooding the server.
+type RateLimiter struct {
+	w      *Writer
+	bucket chan struct{}
+	stop   chan struct{}
+}
+
+// NewRateLimiter wraps w so that Send blocks until a token is
+// available. The bucket holds up to burst tokens and refills at rate
+// tokens per second. A rate or burst of zero or less is replaced by
+// DefaultRateLimit or DefaultRateLimitBurst.
+func NewRateLimiter(w *Writer, rate float64, burst int) *RateLimiter {
+	if rate <= 0 {
+		rate = DefaultRateLimit
+	}
+	if burst <= 0 {
+		burst = DefaultRateLimitBurst
+	}
+	rl := &RateLimiter{
+		w:      w,
+		bucket: make(chan struct{}, burst),
+		stop:   make(chan struct{}),
+	}
+	for i := 0; i < burst; i++ {
+		rl.bucket <- struct{}{}
+	}
+	go rl.fill(rate)
+	return rl
+}
+
+func (rl *RateLimiter) fill(rate float64) {
+	t := time.NewTicker(time.Duration(float64(time.Second) / rate))
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			select {
+			case rl.bucket <- struct{}{}:
+			default:
+			}
+		case <-rl.stop:
+			return
+		}
+	}
+}
+
+// Send blocks until a token is available and then sends msg.
+func (rl *RateLimiter) Send(msg Message) error {
+	<-rl.bucket
+	return rl.w.Send(msg)
+}
+
+// Close stops the token bucket's refill goroutine. Tokens already in the
+// bucket can still be used; once they are gone, pending and future Send
+// calls block forever.
+func (rl *RateLimiter) Close() {
+	close(rl.stop)
+}
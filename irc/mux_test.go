@@ -0,0 +1,137 @@
+package irc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestMuxDispatch(t *testing.T) {
+	m := NewMux()
+	var got Message
+	m.HandleFunc(PRIVMSG, func(_ context.Context, msg Message) error {
+		got = msg
+		return nil
+	})
+	msg, err := Parse("PRIVMSG #test :hi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Dispatch(context.Background(), msg); err != nil {
+		t.Fatalf("Dispatch=%v", err)
+	}
+	if got.Command != PRIVMSG {
+		t.Errorf("handler not called, got %#v", got)
+	}
+}
+
+func TestMuxDefaultHandler(t *testing.T) {
+	m := NewMux()
+	called := false
+	m.HandleDefault(func(context.Context, Message) error {
+		called = true
+		return nil
+	})
+	msg, _ := Parse("NOTICE #test :hi")
+	if err := m.Dispatch(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+	if !called {
+		t.Errorf("default handler not called")
+	}
+}
+
+func TestPingMiddleware(t *testing.T) {
+	var out bytes.Buffer
+	m := NewMux()
+	m.Use(PingMiddleware)
+	m.HandleDefault(func(context.Context, Message) error { return nil })
+
+	in := bufio.NewReader(strings.NewReader("PING :abc\r\n"))
+	if err := m.Serve(context.Background(), in, &out); err != nil {
+		t.Fatalf("Serve=%v", err)
+	}
+	if got := out.String(); got != "PONG :abc\r\n" {
+		t.Errorf("reply=%q, want %q", got, "PONG :abc\r\n")
+	}
+}
+
+func TestRecoveryMiddleware(t *testing.T) {
+	m := NewMux()
+	m.Use(RecoveryMiddleware)
+	m.HandleDefault(func(context.Context, Message) error {
+		panic("boom")
+	})
+	msg, _ := Parse("NOTICE #test :hi")
+	err := m.Dispatch(context.Background(), msg)
+	if err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Errorf("Dispatch=%v, want an error mentioning the panic", err)
+	}
+}
+
+func TestWriterSendTooLong(t *testing.T) {
+	var out bytes.Buffer
+	w := NewWriter(&out)
+	msg := Message{Command: PRIVMSG, Arguments: []string{strings.Repeat("a", MaxBytes)}}
+	err := w.Send(msg)
+	var tooLong MsgTooLong
+	if !errors.As(err, &tooLong) {
+		t.Errorf("Send(too long)=%v, want a MsgTooLong", err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("Send(too long) wrote %d bytes, want 0", out.Len())
+	}
+}
+
+// panicOnceReader panics on its first Read, as a hostile or buggy
+// io.Reader might, then reports EOF on every Read after that.
+type panicOnceReader struct{ panicked bool }
+
+func (r *panicOnceReader) Read(p []byte) (int, error) {
+	if !r.panicked {
+		r.panicked = true
+		panic("simulated I/O panic")
+	}
+	return 0, io.EOF
+}
+
+func TestSafeReadRecoversPanic(t *testing.T) {
+	in := bufio.NewReader(&panicOnceReader{})
+	_, err := safeRead(in)
+	var rp recoveredPanic
+	if !errors.As(err, &rp) {
+		t.Fatalf("safeRead=%v, want a recoveredPanic", err)
+	}
+}
+
+// Tests that Serve survives a panic while reading a single message
+// instead of propagating it, continuing on to the next message (here,
+// the EOF that ends the loop).
+func TestServeRecoversReadPanic(t *testing.T) {
+	m := NewMux()
+	var out bytes.Buffer
+	in := bufio.NewReader(&panicOnceReader{})
+	if err := m.Serve(context.Background(), in, &out); err != nil {
+		t.Fatalf("Serve=%v, want nil (clean EOF after the recovered panic)", err)
+	}
+}
+
+func TestRateLimiterBucket(t *testing.T) {
+	var out bytes.Buffer
+	rl := NewRateLimiter(NewWriter(&out), DefaultRateLimit, 2)
+	defer rl.Close()
+
+	msg, _ := Parse("PING :x")
+	for i := 0; i < 2; i++ {
+		if err := rl.Send(msg); err != nil {
+			t.Fatalf("Send=%v", err)
+		}
+	}
+	if out.String() != "PING :x\r\nPING :x\r\n" {
+		t.Errorf("output=%q", out.String())
+	}
+}
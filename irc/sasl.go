@@ -0,0 +1,363 @@
+package irc
+
+// Client-side SASL authentication, layered on top of CAP negotiation.
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// AUTHENTICATE is the command used to carry a SASL exchange.
+const AUTHENTICATE Command = "AUTHENTICATE"
+
+// A SaslMechanism identifies a SASL authentication mechanism.
+type SaslMechanism string
+
+// The SASL mechanisms that Sasl can drive.
+const (
+	SaslPlain       SaslMechanism = "PLAIN"
+	SaslExternal    SaslMechanism = "EXTERNAL"
+	SaslScramSha256 SaslMechanism = "SCRAM-SHA-256"
+)
+
+// authenticateChunkSize is the maximum number of base64 bytes carried by a
+// single AUTHENTICATE line. Payloads that encode to a multiple of this size
+// are terminated with an "AUTHENTICATE +" line so the server can tell the
+// payload apart from a short final chunk.
+const authenticateChunkSize = 400
+
+// A SaslError is returned by Sasl.Step when the server reports that
+// authentication failed, was aborted, or was already completed.
+type SaslError struct {
+	// Code is the numeric reply that produced the error: one of
+	// ErrSASLFAIL, ErrSASLTOOLONG, ErrSASLABORTED, or ErrSASLALREADY.
+	Code string
+	// Text is the human-readable text of the reply, if any.
+	Text string
+}
+
+func (e SaslError) Error() string {
+	if e.Text == "" {
+		return "SASL error " + e.Code
+	}
+	return fmt.Sprintf("SASL error %s: %s", e.Code, e.Text)
+}
+
+// errSaslUnexpected is returned when the server sends an AUTHENTICATE
+// message that doesn't fit the mechanism's current state.
+var errSaslUnexpected = errors.New("unexpected AUTHENTICATE message")
+
+// A Sasl drives one SASL authentication attempt as a state machine that
+// consumes Messages read from the connection. A caller should send the
+// messages returned by Start and Step, and feed every subsequent
+// AUTHENTICATE or 9xx numeric Message to Step until it reports done.
+//
+// A Sasl is not safe for concurrent use.
+type Sasl struct {
+	mechanism SaslMechanism
+	user      string
+	pass      string
+
+	step  int
+	scram *scramClient
+
+	// newNonce generates the client nonce for SCRAM. It is a field so
+	// that tests can override it with a deterministic source.
+	newNonce func() (string, error)
+}
+
+// NewSaslPlain returns a Sasl that authenticates with the PLAIN
+// mechanism using the given authentication identity and password.
+func NewSaslPlain(user, pass string) *Sasl {
+	return &Sasl{mechanism: SaslPlain, user: user, pass: pass, newNonce: randomNonce}
+}
+
+// NewSaslExternal returns a Sasl that authenticates with the EXTERNAL
+// mechanism, deferring identity to the TLS client certificate.
+func NewSaslExternal() *Sasl {
+	return &Sasl{mechanism: SaslExternal, newNonce: randomNonce}
+}
+
+// NewSaslScramSha256 returns a Sasl that authenticates with the
+// SCRAM-SHA-256 mechanism using the given username and password.
+func NewSaslScramSha256(user, pass string) *Sasl {
+	return &Sasl{mechanism: SaslScramSha256, user: user, pass: pass, newNonce: randomNonce}
+}
+
+// Mechanism returns the mechanism this Sasl authenticates with.
+func (s *Sasl) Mechanism() SaslMechanism {
+	return s.mechanism
+}
+
+// Start returns the message that begins the exchange: "AUTHENTICATE
+// <mechanism>".
+func (s *Sasl) Start() Message {
+	return Message{Command: AUTHENTICATE, Arguments: []string{string(s.mechanism)}}
+}
+
+// Step feeds an incoming message to the state machine. Messages with a
+// Command other than AUTHENTICATE or one of the SASL numerics are
+// ignored. It returns any messages to send in response, whether the
+// exchange is finished, and a non-nil error if the server reported
+// failure.
+func (s *Sasl) Step(msg Message) (reply []Message, done bool, err error) {
+	switch msg.Command {
+	case ErrSASLFAIL, ErrSASLTOOLONG, ErrSASLABORTED, ErrSASLALREADY:
+		return nil, true, SaslError{Code: string(msg.Command), Text: lastArg(msg)}
+
+	case RplSASLSUCCESS:
+		return nil, true, nil
+
+	case AUTHENTICATE:
+		return s.stepAuthenticate(msg)
+
+	default:
+		return nil, false, nil
+	}
+}
+
+func (s *Sasl) stepAuthenticate(msg Message) ([]Message, bool, error) {
+	payload := ""
+	if len(msg.Arguments) > 0 {
+		payload = msg.Arguments[0]
+	}
+
+	switch s.mechanism {
+	case SaslPlain:
+		if payload != "+" || s.step != 0 {
+			return nil, false, errSaslUnexpected
+		}
+		s.step++
+		return authenticateMessages([]byte("\x00" + s.user + "\x00" + s.pass)), false, nil
+
+	case SaslExternal:
+		if payload != "+" || s.step != 0 {
+			return nil, false, errSaslUnexpected
+		}
+		s.step++
+		return authenticateMessages(nil), false, nil
+
+	case SaslScramSha256:
+		return s.stepScram(payload)
+	}
+	return nil, false, errSaslUnexpected
+}
+
+// stepScram advances the SCRAM-SHA-256 client-first/server-first/
+// client-final exchange described in RFC 5802, using "n,," (no channel
+// binding) as the gs2-header.
+func (s *Sasl) stepScram(payload string) ([]Message, bool, error) {
+	switch s.step {
+	case 0:
+		if payload != "+" {
+			return nil, false, errSaslUnexpected
+		}
+		nonce, err := s.newNonce()
+		if err != nil {
+			return nil, false, err
+		}
+		s.scram = &scramClient{user: s.user, pass: s.pass, clientNonce: nonce}
+		s.step++
+		return authenticateMessages([]byte(s.scram.clientFirstMessage())), false, nil
+
+	case 1:
+		data, err := base64.StdEncoding.DecodeString(payload)
+		if err != nil {
+			return nil, false, fmt.Errorf("decoding SCRAM server-first message: %v", err)
+		}
+		final, err := s.scram.clientFinalMessage(string(data))
+		if err != nil {
+			return nil, false, err
+		}
+		s.step++
+		return authenticateMessages([]byte(final)), false, nil
+
+	case 2:
+		data, err := base64.StdEncoding.DecodeString(payload)
+		if err != nil {
+			return nil, false, fmt.Errorf("decoding SCRAM server-final message: %v", err)
+		}
+		if err := s.scram.verifyServerFinalMessage(string(data)); err != nil {
+			return nil, false, err
+		}
+		s.step++
+		return nil, false, nil
+	}
+	return nil, false, errSaslUnexpected
+}
+
+// lastArg returns the last argument of a message, or "" if it has none.
+func lastArg(msg Message) string {
+	if len(msg.Arguments) == 0 {
+		return ""
+	}
+	return msg.Arguments[len(msg.Arguments)-1]
+}
+
+// authenticateMessages splits a SASL payload into base64-encoded
+// AUTHENTICATE lines, following the 400-byte chunking rule: chunks are
+// exactly authenticateChunkSize bytes of base64 except for the last one,
+// and a payload whose encoding is an exact multiple of
+// authenticateChunkSize is terminated with an "AUTHENTICATE +" line. An
+// empty payload is sent as a single "AUTHENTICATE +".
+func authenticateMessages(payload []byte) []Message {
+	if len(payload) == 0 {
+		return []Message{{Command: AUTHENTICATE, Arguments: []string{"+"}}}
+	}
+	enc := base64.StdEncoding.EncodeToString(payload)
+	var msgs []Message
+	for len(enc) > 0 {
+		n := authenticateChunkSize
+		if n > len(enc) {
+			n = len(enc)
+		}
+		msgs = append(msgs, Message{Command: AUTHENTICATE, Arguments: []string{enc[:n]}})
+		enc = enc[n:]
+	}
+	if len(msgs[len(msgs)-1].Arguments[0]) == authenticateChunkSize {
+		msgs = append(msgs, Message{Command: AUTHENTICATE, Arguments: []string{"+"}})
+	}
+	return msgs
+}
+
+// randomNonce returns a random client nonce for use in a SCRAM exchange,
+// encoded with the standard base64 alphabet (without padding), so it
+// never contains a ','.
+func randomNonce() (string, error) {
+	buf := make([]byte, 18)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawStdEncoding.EncodeToString(buf), nil
+}
+
+// A scramClient holds the state needed to complete a SCRAM-SHA-256
+// exchange, as specified by RFC 5802.
+type scramClient struct {
+	user, pass  string
+	clientNonce string
+
+	clientFirstBare string
+	serverFirst     string
+	saltedPassword  []byte
+}
+
+// gs2Header is the GS2 header this client always sends: no channel
+// binding, no authzid.
+const gs2Header = "n,,"
+
+func (c *scramClient) clientFirstMessage() string {
+	c.clientFirstBare = "n=" + scramEscape(c.user) + ",r=" + c.clientNonce
+	return gs2Header + c.clientFirstBare
+}
+
+// clientFinalMessage parses the server-first message, derives the SCRAM
+// keys, and returns the client-final message.
+func (c *scramClient) clientFinalMessage(serverFirst string) (string, error) {
+	c.serverFirst = serverFirst
+	fields := scramFields(serverFirst)
+	nonce, salt, iters := fields["r"], fields["s"], fields["i"]
+	if nonce == "" || salt == "" || iters == "" {
+		return "", fmt.Errorf("malformed SCRAM server-first message: %q", serverFirst)
+	}
+	if !strings.HasPrefix(nonce, c.clientNonce) {
+		return "", fmt.Errorf("SCRAM server nonce %q doesn't extend client nonce %q", nonce, c.clientNonce)
+	}
+	saltBytes, err := base64.StdEncoding.DecodeString(salt)
+	if err != nil {
+		return "", fmt.Errorf("decoding SCRAM salt: %v", err)
+	}
+	var iterCount int
+	if _, err := fmt.Sscanf(iters, "%d", &iterCount); err != nil {
+		return "", fmt.Errorf("parsing SCRAM iteration count %q: %v", iters, err)
+	}
+
+	c.saltedPassword = scramHi([]byte(c.pass), saltBytes, iterCount)
+	clientKey := scramHMAC(c.saltedPassword, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+
+	channelBinding := base64.StdEncoding.EncodeToString([]byte(gs2Header))
+	clientFinalWithoutProof := "c=" + channelBinding + ",r=" + nonce
+	authMessage := c.clientFirstBare + "," + serverFirst + "," + clientFinalWithoutProof
+
+	clientSignature := scramHMAC(storedKey[:], authMessage)
+	proof := make([]byte, len(clientKey))
+	for i := range proof {
+		proof[i] = clientKey[i] ^ clientSignature[i]
+	}
+
+	return clientFinalWithoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof), nil
+}
+
+// verifyServerFinalMessage checks the server's verifier against the
+// ServerSignature computed from the salted password.
+func (c *scramClient) verifyServerFinalMessage(serverFinal string) error {
+	fields := scramFields(serverFinal)
+	if e, ok := fields["e"]; ok {
+		return fmt.Errorf("SCRAM server reported error: %s", e)
+	}
+	v, ok := fields["v"]
+	if !ok {
+		return fmt.Errorf("malformed SCRAM server-final message: %q", serverFinal)
+	}
+	serverKey := scramHMAC(c.saltedPassword, "Server Key")
+	channelBinding := base64.StdEncoding.EncodeToString([]byte(gs2Header))
+	clientFinalWithoutProof := "c=" + channelBinding + ",r=" + scramFields(c.serverFirst)["r"]
+	authMessage := c.clientFirstBare + "," + c.serverFirst + "," + clientFinalWithoutProof
+	serverSignature := scramHMAC(serverKey, authMessage)
+	if v != base64.StdEncoding.EncodeToString(serverSignature) {
+		return errors.New("SCRAM server signature mismatch")
+	}
+	return nil
+}
+
+// scramHMAC returns HMAC-SHA-256(key, data).
+func scramHMAC(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// scramHi is the RFC 5802 Hi(password, salt, iterCount) function:
+// PBKDF2 with HMAC-SHA-256 and a single derived block.
+func scramHi(password, salt []byte, iterCount int) []byte {
+	mac := hmac.New(sha256.New, password)
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+	result := append([]byte(nil), u...)
+	for i := 1; i < iterCount; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(nil)
+		for j := range result {
+			result[j] ^= u[j]
+		}
+	}
+	return result
+}
+
+// scramEscape escapes ',' and '=' in a SCRAM "name" attribute as
+// required by RFC 5802.
+func scramEscape(s string) string {
+	s = strings.ReplaceAll(s, "=", "=3D")
+	s = strings.ReplaceAll(s, ",", "=2C")
+	return s
+}
+
+// scramFields splits a comma-separated SCRAM message into its
+// single-letter attributes, e.g. "r=foo,s=bar,i=4096" →
+// {"r": "foo", "s": "bar", "i": "4096"}.
+func scramFields(msg string) map[string]string {
+	fields := make(map[string]string)
+	for _, part := range strings.Split(msg, ",") {
+		k, v := splitString(part, "=")
+		fields[k] = v
+	}
+	return fields
+}